@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ipv6Family finds download rows with a stored IPv6 address and a NULL country code field
+var ipv6Family = addressFamily{
+	name: "IPv6",
+	selectQuery: `
+		SELECT download_id, request_time, client_ipv6
+		FROM download_log
+		WHERE client_ipv6 IS NOT NULL
+			AND client_country IS NULL
+			AND request_time > $1
+			AND request_time < $2`,
+	lookupCntry: countryLookupIPv6,
+	jobName:     "download_log_country_backfill_ipv6",
+}
+
+// Returns the 3 letter country code associated with a given IPv6 address. The address is
+// parsed into its 16-byte form and split into two offset-binary int64 halves (see
+// ip16ToHiLo), which are matched against
+// country_code_lookups_v6(ipfrom_hi, ipfrom_lo, ipto_hi, ipto_lo, cntry) using a row-wise
+// comparison, the same way the IPv4 lookup treats its 32-bit address as a single integer.
+func countryLookupIPv6(ipAddress string) (country string) {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Unable to parse IPv6 address '%s'\n", ipAddress)
+		return
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Address '%s' is not a valid IPv6 address\n", ipAddress)
+		return
+	}
+	hi, lo := ip16ToHiLo(ip16)
+
+	// IP2Location/GeoLite ranges are inclusive of both bounds, so the comparison has to be
+	// too - a strict < / > would silently miss addresses that exactly equal a range's
+	// ipfrom or ipto.
+	dbQuery := `
+		SELECT cntry
+		FROM country_code_lookups_v6
+		WHERE ROW(ipfrom_hi, ipfrom_lo) <= ROW($1, $2)
+			AND ROW(ipto_hi, ipto_lo) >= ROW($1, $2)`
+	err := pg.QueryRow(context.Background(), dbQuery, hi, lo).Scan(&country)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Looking up the country code for '%s' failed: %v\n", ipAddress, err)
+	}
+	return
+}
+
+// ip16ToHiLo splits a 16-byte IPv6 address into its high and low 64-bit halves, matching
+// the representation used by country_code_lookups_v6
+func ip16ToHiLo(ip16 []byte) (hi, lo int64) {
+	hi = toOffsetBinary(binary.BigEndian.Uint64(ip16[0:8]))
+	lo = toOffsetBinary(binary.BigEndian.Uint64(ip16[8:16]))
+	return
+}
+
+// toOffsetBinary maps a uint64 onto the int64 range by flipping its sign bit, so that
+// ordinary signed comparison (and therefore Postgres' BIGINT ordering) agrees with
+// unsigned ordering. Plain int64(u) would make every half with its top bit set - half of
+// all possible values, including all of fc00::/7 and fe80::/10 - sort as negative and
+// break the ROW() range comparisons in countryLookupIPv6. Both halves of both bounds, and of the looked-up
+// address, must go through this same mapping, which splitBigIPToHiLo also does for the
+// values loaded from CSV.
+func toOffsetBinary(u uint64) int64 {
+	return int64(u ^ 0x8000000000000000)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// runLoad implements the "load" subcommand, which ingests a standard IP2Location/GeoLite
+// CSV file into either country_code_lookups (IPv4) or country_code_lookups_v6 (IPv6), so
+// the lookup tables used by countryLookupIPv4/countryLookupIPv6 can be rebuilt from their
+// canonical CSV source instead of being a one-off hand-populated table.
+func runLoad(args []string) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	family := fs.String("family", "ipv4", "Address family of the CSV file to load: ipv4 or ipv6")
+	file := fs.String("file", "", "Path to the IP2Location/GeoLite CSV file to load")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("load: -file is required")
+	}
+
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	pool, err := connectPG(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	pg = pool
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch *family {
+	case "ipv4":
+		return loadIPv4CSV(ctx, f)
+	case "ipv6":
+		return loadIPv6CSV(ctx, f)
+	default:
+		return fmt.Errorf("load: unknown address family '%s'", *family)
+	}
+}
+
+// loadIPv4CSV reads an IP2Location/GeoLite style CSV (ip_from, ip_to, country_code, ...)
+// with IPv4 addresses expressed as plain integers, and replaces the contents of
+// country_code_lookups with it.
+func loadIPv4CSV(ctx context.Context, r io.Reader) error {
+	cr := csv.NewReader(r)
+	var rowSrc [][]interface{}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(rec) < 3 {
+			continue
+		}
+		ipFrom, err := strconv.ParseInt(rec[0], 10, 64)
+		if err != nil {
+			log.Printf("Skipping row with invalid ip_from '%s': %v\n", rec[0], err)
+			continue
+		}
+		ipTo, err := strconv.ParseInt(rec[1], 10, 64)
+		if err != nil {
+			log.Printf("Skipping row with invalid ip_to '%s': %v\n", rec[1], err)
+			continue
+		}
+		rowSrc = append(rowSrc, []interface{}{ipFrom, ipTo, rec[2]})
+	}
+
+	return replaceLookupTable(ctx, `
+		CREATE TABLE IF NOT EXISTS country_code_lookups (
+			ipfrom BIGINT,
+			ipto BIGINT,
+			cntry TEXT
+		)`, "country_code_lookups", []string{"ipfrom", "ipto", "cntry"}, rowSrc)
+}
+
+// loadIPv6CSV reads an IP2Location/GeoLite style CSV (ip_from, ip_to, country_code, ...)
+// with IPv6 addresses expressed as 128-bit decimal integers, and replaces the contents of
+// country_code_lookups_v6 with it.
+func loadIPv6CSV(ctx context.Context, r io.Reader) error {
+	cr := csv.NewReader(r)
+	var rowSrc [][]interface{}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(rec) < 3 {
+			continue
+		}
+		fromHi, fromLo, err := splitBigIPToHiLo(rec[0])
+		if err != nil {
+			log.Printf("Skipping row with invalid ip_from '%s': %v\n", rec[0], err)
+			continue
+		}
+		toHi, toLo, err := splitBigIPToHiLo(rec[1])
+		if err != nil {
+			log.Printf("Skipping row with invalid ip_to '%s': %v\n", rec[1], err)
+			continue
+		}
+		rowSrc = append(rowSrc, []interface{}{fromHi, fromLo, toHi, toLo, rec[2]})
+	}
+
+	return replaceLookupTable(ctx, `
+		CREATE TABLE IF NOT EXISTS country_code_lookups_v6 (
+			ipfrom_hi BIGINT,
+			ipfrom_lo BIGINT,
+			ipto_hi BIGINT,
+			ipto_lo BIGINT,
+			cntry TEXT
+		)`, "country_code_lookups_v6", []string{"ipfrom_hi", "ipfrom_lo", "ipto_hi", "ipto_lo", "cntry"}, rowSrc)
+}
+
+// replaceLookupTable creates the lookup table if it doesn't exist yet, empties it, and
+// COPYs in the given rows, all inside one transaction.
+func replaceLookupTable(ctx context.Context, createStmt, table string, columns []string, rowSrc [][]interface{}) error {
+	tx, err := pg.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rbErr := tx.Rollback(ctx); rbErr != nil && rbErr != pgx.ErrTxClosed {
+			log.Println(rbErr)
+		}
+	}()
+
+	if _, err = tx.Exec(ctx, createStmt); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "TRUNCATE "+table); err != nil {
+		return err
+	}
+	n, err := tx.CopyFrom(ctx, pgx.Identifier{table}, columns, pgx.CopyFromRows(rowSrc))
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %d rows into %s\n", n, table)
+	return nil
+}
+
+// splitBigIPToHiLo converts a decimal string representing a 128-bit IPv6 address value (as
+// used in IP2Location/GeoLite IPv6 CSV exports) into the high and low 64-bit halves used
+// by country_code_lookups_v6, matching the representation ip16ToHiLo produces - including
+// its offset-binary mapping, which this must apply too or stored ranges won't agree with
+// what countryLookupIPv6 compares against.
+func splitBigIPToHiLo(s string) (hi, lo int64, err error) {
+	n := new(big.Int)
+	if _, ok := n.SetString(s, 10); !ok {
+		return 0, 0, fmt.Errorf("invalid 128-bit integer '%s'", s)
+	}
+	mask := new(big.Int).SetUint64(^uint64(0))
+	loBig := new(big.Int).And(n, mask)
+	hiBig := new(big.Int).Rsh(n, 64)
+	return toOffsetBinary(hiBig.Uint64()), toOffsetBinary(loBig.Uint64()), nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -11,7 +13,9 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/mitchellh/go-homedir"
 )
 
@@ -20,15 +24,61 @@ type TomlConfig struct {
 	Pg PGInfo
 }
 type PGInfo struct {
-	Database       string
-	NumConnections int `toml:"num_connections"`
-	Port           int
-	Password       string
-	Server         string
-	SSL            bool
-	Username       string
+	Database               string
+	DSN                    string `toml:"dsn"`
+	NumConnections         int    `toml:"num_connections"`
+	Port                   int
+	Password               string
+	Server                 string
+	SSL                    bool
+	Username               string
+	ApplicationName        string `toml:"application_name"`
+	PoolMaxConns           int    `toml:"pool_max_conns"`
+	PoolMinConns           int    `toml:"pool_min_conns"`
+	StatementCacheCapacity int    `toml:"statement_cache_capacity"`
+	BatchSize              int    `toml:"batch_size"`
+	MaxRetries             int    `toml:"max_retries"`
+	Mode                   string `toml:"mode"`
 }
 
+// countryUpdate is a single {download_id, country} pair awaiting a batched update
+type countryUpdate struct {
+	downloadID int64
+	country    string
+}
+
+// defaultBatchSize is used when Pg.BatchSize isn't set in the config file
+const defaultBatchSize = 5000
+
+// defaultMaxRetries is used when Pg.MaxRetries isn't set in the config file
+const defaultMaxRetries = 5
+
+// initialRetryBackoff is the delay before the first retry of a failed transaction;
+// it doubles on each subsequent attempt
+const initialRetryBackoff = 100 * time.Millisecond
+
+// Postgres error codes that indicate a transaction failed only because of contention
+// with another transaction, and is therefore safe to retry from scratch
+const (
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+)
+
+// sqlStateUndefinedTable is returned when querying download_log_updater_state before
+// it's been created by the first successful checkpoint save
+const sqlStateUndefinedTable = "42P01"
+
+// defaultBackfillStart is used as the start of the range to process when neither -from
+// nor a checkpoint in download_log_updater_state is available
+var defaultBackfillStart = time.Date(2019, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// defaultWindow is used when -window isn't given
+const defaultWindow = time.Hour * 24 * 31
+
+// defaultLag is how far behind now() processing stops when -to isn't given, so rows
+// that are still in the process of being inserted aren't missed
+const defaultLag = 5 * time.Minute
+
 var (
 	// Application config
 	Conf TomlConfig
@@ -36,48 +86,58 @@ var (
 	// Display debugging messages?
 	debug = false
 
-	// PostgreSQL Connection pool
-	pg *pgx.ConnPool
+	// PostgreSQL connection pool
+	pg *pgxpool.Pool
+
+	// Overrides the config file location alongside the CONFIG_FILE environment variable
+	configFlag = flag.String("config", "", "Path to the TOML config file (overrides CONFIG_FILE)")
+
+	// Start of the range to process; defaults to resuming from the last checkpoint, or
+	// defaultBackfillStart if there isn't one yet
+	fromFlag = flag.String("from", "", "Start of the range to process (RFC3339), defaults to the last checkpoint")
+
+	// End of the range to process; defaults to now() - defaultLag
+	toFlag = flag.String("to", "", "End of the range to process (RFC3339), defaults to now() minus a small lag")
+
+	// Size of each chunk walked between -from and -to
+	windowFlag = flag.Duration("window", defaultWindow, "Size of each chunk walked between -from and -to")
+
+	// When set, the row enumeration runs in its own deferrable read-only snapshot
+	// transaction, decoupled from the read-write update transactions
+	snapshotSelect = flag.Bool("snapshot-select", false,
+		"Run the SELECT phase in a separate deferrable read-only SERIALIZABLE snapshot transaction")
 
-	// The starting point in time for entries to be processed, and the length of time to cover
-	startTime  = time.Date(2019, time.April, 1, 0, 0, 0, 0, time.UTC)
-	timePeriod = time.Hour * 24 * 31
+	// When set, stay running after the initial back-fill and apply country codes to
+	// newly-inserted rows as they're announced via LISTEN/NOTIFY
+	daemon = flag.Bool("daemon", false,
+		"After the initial back-fill, keep running and process new rows via LISTEN/NOTIFY")
 )
 
+// daemonMode reports whether the updater should stay running in LISTEN/NOTIFY mode after
+// its initial back-fill, as requested via -daemon or `mode = "listen"` in the TOML config
+func daemonMode() bool {
+	return *daemon || strings.EqualFold(Conf.Pg.Mode, "listen")
+}
+
 func main() {
-	// Override config file location via environment variables
-	var err error
-	configFile := os.Getenv("CONFIG_FILE")
-	if configFile == "" {
-		userHome, err := homedir.Dir()
-		if err != nil {
-			log.Fatalf("User home directory couldn't be determined: %s", "\n")
+	// The "load" subcommand ingests a lookup CSV instead of running the updater itself
+	if len(os.Args) > 1 && os.Args[1] == "load" {
+		if err := runLoad(os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
-		configFile = filepath.Join(userHome, ".db4s", "status_updater.toml")
+		return
 	}
 
-	// Read our configuration settings
-	if _, err = toml.DecodeFile(configFile, &Conf); err != nil {
-		log.Fatal(err)
-	}
+	flag.Parse()
 
-	// Setup the PostgreSQL config
-	pgConfig := new(pgx.ConnConfig)
-	pgConfig.Host = Conf.Pg.Server
-	pgConfig.Port = uint16(Conf.Pg.Port)
-	pgConfig.User = Conf.Pg.Username
-	pgConfig.Password = Conf.Pg.Password
-	pgConfig.Database = Conf.Pg.Database
-	clientTLSConfig := tls.Config{InsecureSkipVerify: true}
-	if Conf.Pg.SSL {
-		pgConfig.TLSConfig = &clientTLSConfig
-	} else {
-		pgConfig.TLSConfig = nil
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
 	}
 
 	// Connect to PG
-	pgPoolConfig := pgx.ConnPoolConfig{*pgConfig, Conf.Pg.NumConnections, nil, 5 * time.Second}
-	pg, err = pgx.NewConnPool(pgPoolConfig)
+	ctx := context.Background()
+	var err error
+	pg, err = connectPG(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -88,11 +148,292 @@ func main() {
 		fmt.Printf("Connected to PostgreSQL server: %v\n", Conf.Pg.Server)
 	}
 
-	// Process entries from the given starting point
-	err = processRange(startTime)
+	// Back-fill country codes for both IPv4 and IPv6 download rows, walking forward in -window sized
+	// chunks up to -to (or now() minus a small lag). Each address family resumes from its
+	// own checkpoint in download_log_updater_state unless -from was given explicitly.
+	end, err := resolveEndTime()
 	if err != nil {
-		log.Print(err)
+		log.Fatal(err)
+	}
+	for _, fam := range addressFamilies {
+		if err := backfillFamily(ctx, fam, end); err != nil {
+			log.Print(err)
+		}
 	}
+
+	// Once the back-fill is done, optionally stay running and apply country codes to
+	// newly-inserted rows in near real time
+	if daemonMode() {
+		if err := runDaemon(ctx); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// loadConfig reads the TOML config file into Conf, honouring -config and the CONFIG_FILE
+// environment variable as overrides of the default location
+func loadConfig() error {
+	configFile := *configFlag
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+	if configFile == "" {
+		userHome, err := homedir.Dir()
+		if err != nil {
+			return fmt.Errorf("user home directory couldn't be determined: %w", err)
+		}
+		configFile = filepath.Join(userHome, ".db4s", "status_updater.toml")
+	}
+	_, err := toml.DecodeFile(configFile, &Conf)
+	return err
+}
+
+// resolveEndTime returns -to parsed as RFC3339, or now() minus defaultLag if it wasn't given
+func resolveEndTime() (time.Time, error) {
+	if *toFlag == "" {
+		return time.Now().Add(-defaultLag), nil
+	}
+	t, err := time.Parse(time.RFC3339, *toFlag)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -to value '%s': %w", *toFlag, err)
+	}
+	return t, nil
+}
+
+// backfillFamily walks from fam's resolved start time to end in -window sized chunks,
+// processing each one in turn and stopping at the first error
+func backfillFamily(ctx context.Context, fam addressFamily, end time.Time) error {
+	start, err := resolveStartTime(ctx, fam)
+	if err != nil {
+		return err
+	}
+
+	window := *windowFlag
+	if window <= 0 {
+		window = defaultWindow
+	}
+
+	for start.Before(end) {
+		chunkEnd := start.Add(window)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+
+		if *snapshotSelect {
+			err = processRangeSnapshot(ctx, fam, start, chunkEnd)
+		} else {
+			err = withRetry(ctx, func(ctx context.Context, tx pgx.Tx) error {
+				return processRange(ctx, tx, fam, start, chunkEnd)
+			})
+		}
+		if err != nil {
+			return err
+		}
+		start = chunkEnd
+	}
+	return nil
+}
+
+// resolveStartTime returns -from parsed as RFC3339 if it was given, otherwise fam's
+// checkpoint from download_log_updater_state, falling back to defaultBackfillStart if
+// there isn't one yet
+func resolveStartTime(ctx context.Context, fam addressFamily) (time.Time, error) {
+	if *fromFlag != "" {
+		t, err := time.Parse(time.RFC3339, *fromFlag)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid -from value '%s': %w", *fromFlag, err)
+		}
+		return t, nil
+	}
+
+	checkpoint, ok, err := getCheckpoint(ctx, fam.jobName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ok {
+		return checkpoint, nil
+	}
+	return defaultBackfillStart, nil
+}
+
+// getCheckpoint returns the last_processed time saved for jobName in
+// download_log_updater_state, and false if there's no checkpoint yet (either because the
+// job's never run before, or the state table hasn't been created yet)
+func getCheckpoint(ctx context.Context, jobName string) (time.Time, bool, error) {
+	var lastProcessed time.Time
+	err := pg.QueryRow(ctx, `
+		SELECT last_processed
+		FROM download_log_updater_state
+		WHERE job_name = $1`, jobName).Scan(&lastProcessed)
+	if err == nil {
+		return lastProcessed, true, nil
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == sqlStateUndefinedTable {
+		return time.Time{}, false, nil
+	}
+	return time.Time{}, false, err
+}
+
+// saveCheckpoint records the last successfully processed request_time for jobName, inside
+// the same transaction that commits the batch updates for that chunk
+func saveCheckpoint(ctx context.Context, tx pgx.Tx, jobName string, lastProcessed time.Time) error {
+	_, err := tx.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS download_log_updater_state (
+			job_name TEXT PRIMARY KEY,
+			last_processed TIMESTAMPTZ,
+			updated_at TIMESTAMPTZ
+		)`)
+	if err != nil {
+		log.Printf("Creating download_log_updater_state failed: %v\n", err)
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO download_log_updater_state (job_name, last_processed, updated_at)
+		VALUES ($1, $2, now())
+		ON CONFLICT (job_name) DO UPDATE
+			SET last_processed = EXCLUDED.last_processed,
+				updated_at = EXCLUDED.updated_at`, jobName, lastProcessed)
+	if err != nil {
+		log.Printf("Saving checkpoint for job '%s' failed: %v\n", jobName, err)
+	}
+	return err
+}
+
+// connectPG builds the pgx pool config and connects to PostgreSQL. Everything goes
+// through pgxpool.ParseConfig(), so a full libpq-style DSN (sslmode, application_name,
+// pool_max_conns, etc) can be supplied directly in Pg.DSN, or picked up from PGPASSFILE /
+// PGSERVICEFILE / standard PG* environment variables. The individual TOML fields are kept
+// as a fallback for people who don't want to hand-write a connection string.
+func connectPG(ctx context.Context) (*pgxpool.Pool, error) {
+	dsn := Conf.Pg.DSN
+	if dsn == "" {
+		dsn = buildDSN(Conf.Pg)
+	}
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return pgxpool.NewWithConfig(ctx, poolConfig)
+}
+
+// withRetry runs fn inside a SERIALIZABLE transaction, committing on success. If the
+// transaction fails with a serialization_failure (40001) or deadlock_detected (40P01),
+// it's rolled back and retried from scratch, up to Pg.MaxRetries times with exponential
+// backoff between attempts. All read-write transactional work of the updater is dispatched
+// through here, so callers don't need to deal with retry logic themselves; the read-only
+// enumeration in processRangeSnapshot and the load subcommand begin their own transactions.
+func withRetry(ctx context.Context, fn func(ctx context.Context, tx pgx.Tx) error) (err error) {
+	maxRetries := Conf.Pg.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
+	backoff := initialRetryBackoff
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying transaction after error (attempt %d/%d): %v\n", attempt, maxRetries, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = runOnce(ctx, fn)
+		if err == nil {
+			return nil
+		}
+		if !isRetryableError(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("transaction still failing after %d retries: %w", maxRetries, err)
+}
+
+// runOnce begins a single SERIALIZABLE transaction, runs fn inside it, and commits.
+// The transaction is rolled back automatically if fn or the commit fails.
+func runOnce(ctx context.Context, fn func(ctx context.Context, tx pgx.Tx) error) (err error) {
+	tx, err := pg.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rbErr := tx.Rollback(ctx); rbErr != nil && rbErr != pgx.ErrTxClosed {
+			log.Println(rbErr)
+		}
+	}()
+
+	if err = fn(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// isRetryableError reports whether err is a Postgres serialization_failure or
+// deadlock_detected error, meaning the transaction can simply be re-run from scratch.
+func isRetryableError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == sqlStateSerializationFailure || pgErr.Code == sqlStateDeadlockDetected
+}
+
+// buildDSN composes a libpq-style connection string from the legacy TOML fields, so it
+// can be handed to pgxpool.ParseConfig() the same way a user-supplied DSN would be. This
+// lets pgx build the TLS config itself (including real sslmode=verify-full support)
+// instead of us hard coding InsecureSkipVerify.
+func buildDSN(p PGInfo) string {
+	var parts []string
+	if p.Server != "" {
+		parts = append(parts, "host="+dsnValue(p.Server))
+	}
+	if p.Port != 0 {
+		parts = append(parts, "port="+strconv.Itoa(p.Port))
+	}
+	if p.Username != "" {
+		parts = append(parts, "user="+dsnValue(p.Username))
+	}
+	if p.Password != "" {
+		parts = append(parts, "password="+dsnValue(p.Password))
+	}
+	if p.Database != "" {
+		parts = append(parts, "dbname="+dsnValue(p.Database))
+	}
+	if p.SSL {
+		parts = append(parts, "sslmode=verify-full")
+	} else {
+		parts = append(parts, "sslmode=disable")
+	}
+	if p.ApplicationName != "" {
+		parts = append(parts, "application_name="+dsnValue(p.ApplicationName))
+	}
+	// PoolMaxConns is the modern name for this setting; NumConnections is kept only as a
+	// fallback for older config files, so only one pool_max_conns= token is ever emitted.
+	if p.PoolMaxConns != 0 {
+		parts = append(parts, "pool_max_conns="+strconv.Itoa(p.PoolMaxConns))
+	} else if p.NumConnections != 0 {
+		parts = append(parts, "pool_max_conns="+strconv.Itoa(p.NumConnections))
+	}
+	if p.PoolMinConns != 0 {
+		parts = append(parts, "pool_min_conns="+strconv.Itoa(p.PoolMinConns))
+	}
+	if p.StatementCacheCapacity != 0 {
+		parts = append(parts, "statement_cache_capacity="+strconv.Itoa(p.StatementCacheCapacity))
+	}
+	return strings.Join(parts, " ")
+}
+
+// dsnValue quotes and escapes a value for use in a libpq keyword/value connection string
+// (as opposed to a postgres:// URL, which uses different, percent-encoding based escaping).
+// Quoting unconditionally is always valid and keeps this simple, so it's not limited to
+// only the values that happen to need it.
+func dsnValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
 }
 
 // Returns the 3 letter country code associated with a given IPv4 address
@@ -101,23 +442,28 @@ func countryLookupIPv4(ipAddress string) (country string) {
 	var part1, part2, part3, part4 int
 	ip := strings.Split(ipAddress, ".")
 	if len(ip) != 4 {
-		log.Fatalf("Unknown IPv4 address string format")
+		_, _ = fmt.Fprintf(os.Stderr, "Unable to parse IPv4 address '%s'\n", ipAddress)
+		return
 	}
 	part1, err := strconv.Atoi(ip[0])
 	if err != nil {
-		log.Fatal(err)
+		_, _ = fmt.Fprintf(os.Stderr, "Unable to parse IPv4 address '%s': %v\n", ipAddress, err)
+		return
 	}
 	part2, err = strconv.Atoi(ip[1])
 	if err != nil {
-		log.Fatal(err)
+		_, _ = fmt.Fprintf(os.Stderr, "Unable to parse IPv4 address '%s': %v\n", ipAddress, err)
+		return
 	}
 	part3, err = strconv.Atoi(ip[2])
 	if err != nil {
-		log.Fatal(err)
+		_, _ = fmt.Fprintf(os.Stderr, "Unable to parse IPv4 address '%s': %v\n", ipAddress, err)
+		return
 	}
 	part4, err = strconv.Atoi(ip[3])
 	if err != nil {
-		log.Fatal(err)
+		_, _ = fmt.Fprintf(os.Stderr, "Unable to parse IPv4 address '%s': %v\n", ipAddress, err)
+		return
 	}
 
 	// Convert the IP address pieces to the correct lookup value
@@ -129,116 +475,387 @@ func countryLookupIPv4(ipAddress string) (country string) {
 		FROM country_code_lookups
 		WHERE ipfrom < $1
 			AND ipto > $2`
-	err = pg.QueryRow(dbQuery, ipVal, ipVal).Scan(&country)
+	err = pg.QueryRow(context.Background(), dbQuery, ipVal, ipVal).Scan(&country)
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "Looking up the country code for '%s' failed: %v\n", ipAddress, err)
 	}
 	return
 }
 
-// This function does the actual work of querying the PG database and updating rows with the country code
-func processRange(startTime time.Time) (err error) {
-	// Determine the end processing time
-	endTime := startTime.Add(timePeriod)
+// addressFamily bundles what's needed to back-fill one of the client_ipv4/client_ipv6
+// columns: the SELECT that finds unprocessed rows for it, and the lookup function that
+// resolves one of its addresses to a country code.
+type addressFamily struct {
+	name        string
+	selectQuery string
+	lookupCntry func(ipAddress string) string
+
+	// jobName keys this family's checkpoint row in download_log_updater_state
+	jobName string
+}
+
+// addressFamilies lists every address family main backfills on each invocation
+var addressFamilies = []addressFamily{ipv4Family, ipv6Family}
+
+// ipv4Family finds download rows with a stored IPv4 address and a NULL country code field
+var ipv4Family = addressFamily{
+	name: "IPv4",
+	selectQuery: `
+		SELECT download_id, request_time, client_ipv4
+		FROM download_log
+		WHERE client_ipv4 IS NOT NULL
+			AND client_country IS NULL
+			AND request_time > $1
+			AND request_time < $2`,
+	lookupCntry: countryLookupIPv4,
+	jobName:     "download_log_country_backfill_ipv4",
+}
+
+// This function does the actual work of querying the PG database and updating rows with the country code.
+// It runs entirely within the transaction handed to it by withRetry, so it must not begin, commit, or
+// roll back that transaction itself.
+func processRange(ctx context.Context, tx pgx.Tx, fam addressFamily, startTime, endTime time.Time) (err error) {
+	// Display the date range being processed
+	fmt.Printf("Processing %s range '%v' - '%v'\n", fam.name, startTime.UTC().Format(time.RFC822),
+		endTime.UTC().Format(time.RFC822))
 
-	// Begin PostgreSQL transaction
-	tx, err := pg.Begin()
+	rows, err := tx.Query(ctx, fam.selectQuery, startTime, endTime)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Retrieving unprocessed %s addresses failed: %v\n", fam.name, err)
+		return // This will automatically call the transaction rollback code
+	}
+
+	// The SELECT must be fully drained (and rows closed) before issuing any Exec/CopyFrom
+	// on tx below - it's the same connection, and pgx doesn't allow interleaving a
+	// streaming result with other commands on it.
+	updates, err := scanUpdates(fam, rows)
+	if err != nil {
+		return // This will automatically call the transaction rollback code
+	}
+
+	numUpdated, err := applyInBatches(updates, batchSize(), func(batch []countryUpdate) error {
+		return applyCountryUpdates(ctx, tx, batch)
+	})
+	if err != nil {
+		return // This will automatically call the outer transaction rollback code
 	}
 
-	// Set up an automatic transaction roll back if the function exits without committing
+	if err = saveCheckpoint(ctx, tx, fam.jobName, endTime); err != nil {
+		return
+	}
+
+	// Display completion message
+	fmt.Printf("%s country codes updated (%d rows) for '%v' - '%v'\n", fam.name, numUpdated,
+		startTime.UTC().Format(time.RFC822), endTime.UTC().Format(time.RFC822))
+	return
+}
+
+// processRangeSnapshot is the --snapshot-select counterpart to processRange. The row
+// enumeration runs in its own deferrable, read-only SERIALIZABLE transaction, which is
+// guaranteed never to be aborted by serialization conflicts and can stream through a large
+// range without holding row locks or blocking writers on download_log. DeferrableMode only
+// has an effect at SERIALIZABLE - Postgres ignores it at REPEATABLE READ - so that's the
+// isolation level this has to use to get that guarantee. Each batch of updates is then
+// applied in its own read-write transaction via withRetry.
+func processRangeSnapshot(ctx context.Context, fam addressFamily, startTime, endTime time.Time) (err error) {
+	tx, err := pg.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:       pgx.Serializable,
+		AccessMode:     pgx.ReadOnly,
+		DeferrableMode: pgx.Deferrable,
+	})
+	if err != nil {
+		return err
+	}
 	defer func() {
-		err = tx.Rollback()
-		if err != nil {
-			log.Println(err)
+		if rbErr := tx.Rollback(ctx); rbErr != nil && rbErr != pgx.ErrTxClosed {
+			log.Println(rbErr)
 		}
 	}()
 
-	// Select all download rows with a stored IPv4 address and a NULL country code field
+	fmt.Printf("Processing %s range '%v' - '%v' (snapshot select)\n", fam.name, startTime.UTC().Format(time.RFC822),
+		endTime.UTC().Format(time.RFC822))
 
-	// Display the date range being processed
-	fmt.Printf("Processing range '%v' - '%v'\n", startTime.UTC().Format(time.RFC822), endTime.UTC().Format(time.RFC822))
+	rows, err := tx.Query(ctx, fam.selectQuery, startTime, endTime)
+	if err != nil {
+		log.Printf("Retrieving unprocessed %s addresses failed: %v\n", fam.name, err)
+		return err
+	}
 
-	var rows *pgx.Rows
-	dbQuery := `
-		SELECT download_id, request_time, client_ipv4
-		FROM download_log
-		WHERE client_ipv4 IS NOT NULL
-			AND client_country IS NULL
-			AND request_time > $1
-			AND request_time < $2`
-	rows, err = tx.Query(dbQuery, startTime, endTime)
+	updates, err := scanUpdates(fam, rows)
 	if err != nil {
-		log.Printf("Retrieving unprocessed IPv4 addresses failed: %v\n", err)
-		return // This will automatically call the transaction rollback code
+		return err
+	}
+
+	numUpdated, err := applyInBatches(updates, batchSize(), func(batch []countryUpdate) error {
+		return withRetry(ctx, func(ctx context.Context, utx pgx.Tx) error {
+			return applyCountryUpdates(ctx, utx, batch)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Unlike processRange, this can't save the checkpoint inside the same transaction that
+	// commits the batch updates - the batches here are each applied in their own withRetry
+	// transaction, separate from the read-only tx doing the enumeration above. That's safe
+	// because a crash between the last batch commit and this one just means the next run
+	// re-scans (and no-ops over) already-updated rows: the client_country IS NULL filter in
+	// fam.selectQuery makes that idempotent.
+	if err = withRetry(ctx, func(ctx context.Context, utx pgx.Tx) error {
+		return saveCheckpoint(ctx, utx, fam.jobName, endTime)
+	}); err != nil {
+		return err
 	}
-	var countryCode, ipAddress string
+
+	fmt.Printf("%s country codes updated (%d rows) for '%v' - '%v'\n", fam.name, numUpdated,
+		startTime.UTC().Format(time.RFC822), endTime.UTC().Format(time.RFC822))
+	return nil
+}
+
+// batchSize returns the configured Pg.BatchSize, falling back to defaultBatchSize
+func batchSize() int {
+	if Conf.Pg.BatchSize > 0 {
+		return Conf.Pg.BatchSize
+	}
+	return defaultBatchSize
+}
+
+// scanUpdates fully drains rows into a slice of countryUpdate, doing the country code
+// lookup for each one along the way. rows is always closed before this returns, so the
+// connection it was issued on is free again - callers that enumerate and apply on the same
+// pgx.Tx (such as processRange) must scan every row before issuing any Exec/CopyFrom on that
+// tx, since a pgx.Tx is a single connection and can't interleave a streaming query result
+// with other commands on it.
+func scanUpdates(fam addressFamily, rows pgx.Rows) (updates []countryUpdate, err error) {
+	defer rows.Close()
+
+	var ipAddress string
 	var reqTime time.Time
 	var downloadID int64
 	for rows.Next() {
 		err = rows.Scan(&downloadID, &reqTime, &ipAddress)
 		if err != nil {
-			log.Printf("Error retrieving unprocessed IPv4 address: %v\n", err)
-			rows.Close()
-			return // This will automatically call the transaction rollback code
-		}
-
-		// Do the country code lookup for the IPv4 address
-		countryCode = countryLookupIPv4(ipAddress)
-		if countryCode != "" {
-			// Debugging info
-			if debug {
-				log.Printf("Processing request #%d dated '%v' : IPv4: '%s' : Country code: '%s'\n",
-					downloadID, reqTime.UTC().Format(time.RFC822), ipAddress, countryCode)
-			}
-
-			// * Update the download row with the country code information *
-
-			// Begin nested PostgreSQL transaction
-			var tx2 *pgx.Tx
-			tx2, err = pg.Begin()
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// Save the updated list for the user back to PG
-			var commandTag pgx.CommandTag
-			dbQuery = `
-				UPDATE download_log
-				SET client_country = $2
-				WHERE download_id = $1`
-			commandTag, err = tx2.Exec(dbQuery, downloadID, countryCode)
-			if err != nil {
-				log.Printf("Updating download ID '%d' with country code '%s' failed: %v", downloadID, countryCode,
-					err)
-				err2 := tx2.Rollback()
-				if err2 != nil {
-					log.Print(err2)
-				}
-				return // This will automatically call the outer transaction rollback code
-			}
-			if numRows := commandTag.RowsAffected(); numRows != 1 {
-				log.Printf("Wrong number of rows affected (%v) when updating download ID '%d' with country code "+
-					"'%s'", numRows, downloadID, countryCode)
-				err = tx2.Rollback()
-				if err != nil {
-					log.Print(err)
-				}
-				return // This will automatically call the outer transaction rollback code
-			}
-
-			// Commit nested PostgreSQL transaction
-			err = tx2.Commit()
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	}
-	// This seems to commit the outer transaction, so no need to do it explicitly
-	rows.Close()
+			log.Printf("Error retrieving unprocessed %s address: %v\n", fam.name, err)
+			return nil, err
+		}
 
-	// Display completion message
-	fmt.Printf("Country codes updated for '%v' - '%v'\n", startTime.UTC().Format(time.RFC822),  endTime.UTC().Format(time.RFC822))
-	return
+		// Do the country code lookup for the address. lookupCntry must never abort the
+		// process on a malformed address - this runs inside the SERIALIZABLE transaction
+		// withRetry dispatches, so a log.Fatal here would bypass its rollback/retry handling
+		// entirely instead of just skipping the one bad row.
+		countryCode := fam.lookupCntry(ipAddress)
+		if countryCode == "" {
+			continue
+		}
+
+		// Debugging info
+		if debug {
+			log.Printf("Processing request #%d dated '%v' : %s: '%s' : Country code: '%s'\n",
+				downloadID, reqTime.UTC().Format(time.RFC822), fam.name, ipAddress, countryCode)
+		}
+
+		updates = append(updates, countryUpdate{downloadID: downloadID, country: countryCode})
+	}
+	return updates, rows.Err()
+}
+
+// applyInBatches hands updates to apply in chunks of at most size, stopping at the first
+// error. It's shared between processRange and processRangeSnapshot, which differ only in
+// what apply does with each batch.
+func applyInBatches(updates []countryUpdate, size int, apply func(batch []countryUpdate) error) (numUpdated int, err error) {
+	for len(updates) > 0 {
+		n := size
+		if n > len(updates) {
+			n = len(updates)
+		}
+		if err = apply(updates[:n]); err != nil {
+			return numUpdated, err
+		}
+		numUpdated += n
+		updates = updates[n:]
+	}
+	return numUpdated, nil
+}
+
+// applyCountryUpdates bulk-applies a batch of {download_id, country} pairs to download_log.
+// It COPYs the batch into a temp table, then joins against it in a single UPDATE statement,
+// instead of issuing one UPDATE per row.
+func applyCountryUpdates(ctx context.Context, tx pgx.Tx, batch []countryUpdate) error {
+	_, err := tx.Exec(ctx, `
+		CREATE TEMP TABLE IF NOT EXISTS download_country_updates (
+			download_id BIGINT,
+			cntry TEXT
+		) ON COMMIT DROP`)
+	if err != nil {
+		log.Printf("Creating temp table for country code updates failed: %v\n", err)
+		return err
+	}
+	_, err = tx.Exec(ctx, `TRUNCATE download_country_updates`)
+	if err != nil {
+		log.Printf("Truncating temp table for country code updates failed: %v\n", err)
+		return err
+	}
+
+	rowSrc := make([][]interface{}, len(batch))
+	for i, u := range batch {
+		rowSrc[i] = []interface{}{u.downloadID, u.country}
+	}
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"download_country_updates"},
+		[]string{"download_id", "cntry"},
+		pgx.CopyFromRows(rowSrc))
+	if err != nil {
+		log.Printf("Copying %d country code updates into the temp table failed: %v\n", len(batch), err)
+		return err
+	}
+
+	commandTag, err := tx.Exec(ctx, `
+		UPDATE download_log
+		SET client_country = u.cntry
+		FROM download_country_updates u
+		WHERE download_log.download_id = u.download_id`)
+	if err != nil {
+		log.Printf("Bulk updating %d rows with country code information failed: %v\n", len(batch), err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != int64(len(batch)) {
+		log.Printf("Wrong number of rows affected (%v) when bulk updating %d country code updates", numRows,
+			len(batch))
+	}
+	return nil
+}
+
+// listenChannel is the channel name new download_log rows are pg_notify'd on, eg from a
+// trigger:
+//
+//	CREATE TRIGGER download_log_inserted AFTER INSERT ON download_log
+//		FOR EACH ROW EXECUTE PROCEDURE pg_notify('download_log_inserted', NEW.download_id::text);
+const listenChannel = "download_log_inserted"
+
+// reconnectDelay is how long the daemon waits before re-acquiring a LISTEN connection
+// after one drops
+const reconnectDelay = 5 * time.Second
+
+// coalesceWindow is how long the daemon keeps draining further notifications after the
+// first one in a burst, before applying the accumulated batch in one go
+const coalesceWindow = 500 * time.Millisecond
+
+// runDaemon keeps a dedicated connection LISTENing on listenChannel, reconnecting
+// automatically whenever the connection drops, until ctx is cancelled
+func runDaemon(ctx context.Context) error {
+	fmt.Printf("Entering daemon mode, listening for new download_log rows\n")
+	for {
+		err := listenOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("LISTEN connection lost, reconnecting in %v: %v\n", reconnectDelay, err)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// listenOnce acquires a dedicated connection, LISTENs for newly-inserted download_log
+// rows, and processes them as they arrive until the connection breaks
+func listenOnce(ctx context.Context) error {
+	conn, err := pg.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, "LISTEN "+listenChannel); err != nil {
+		return err
+	}
+
+	for {
+		ids, err := collectNotificationBurst(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err = processNotifiedIDs(ctx, ids); err != nil {
+			log.Printf("Processing notified download IDs failed: %v\n", err)
+		}
+	}
+}
+
+// collectNotificationBurst blocks until the first notification arrives, then keeps
+// draining any further notifications that arrive within coalesceWindow, returning the
+// full set of download IDs gathered from the burst
+func collectNotificationBurst(ctx context.Context, conn *pgxpool.Conn) (ids []int64, err error) {
+	notif, err := conn.Conn().WaitForNotification(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, parseNotificationPayload(notif.Payload)...)
+
+	deadline := time.Now().Add(coalesceWindow)
+	for {
+		waitCtx, cancel := context.WithDeadline(ctx, deadline)
+		notif, waitErr := conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if waitErr != nil {
+			// Either the coalesce window expired, or ctx was cancelled - either way,
+			// flush what's been gathered so far
+			return ids, nil
+		}
+		ids = append(ids, parseNotificationPayload(notif.Payload)...)
+	}
+}
+
+// parseNotificationPayload parses a pg_notify payload as a download_id, logging and
+// discarding it if it isn't one
+func parseNotificationPayload(payload string) []int64 {
+	id, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		log.Printf("Ignoring notification with non-numeric payload '%s': %v\n", payload, err)
+		return nil
+	}
+	return []int64{id}
+}
+
+// processNotifiedIDs looks up the country code for each notified download_id and applies
+// the whole batch in a single transaction, reusing the same batched COPY path as the
+// back-fill
+func processNotifiedIDs(ctx context.Context, ids []int64) error {
+	batch := make([]countryUpdate, 0, len(ids))
+	for _, id := range ids {
+		ipAddress, fam, err := downloadAddress(ctx, id)
+		if err != nil {
+			log.Printf("Looking up address for download ID '%d' failed: %v\n", id, err)
+			continue
+		}
+		// lookupCntry must never abort the process on a malformed address - runDaemon has
+		// no restart logic around this call, so a log.Fatal here would permanently kill the
+		// daemon on the first bad notification instead of just skipping that one row.
+		countryCode := fam.lookupCntry(ipAddress)
+		if countryCode == "" {
+			continue
+		}
+		batch = append(batch, countryUpdate{downloadID: id, country: countryCode})
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return withRetry(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		return applyCountryUpdates(ctx, tx, batch)
+	})
+}
+
+// downloadAddress looks up the stored client address for a single download_log row,
+// along with which address family it belongs to
+func downloadAddress(ctx context.Context, downloadID int64) (ipAddress string, fam addressFamily, err error) {
+	var ipv4, ipv6 *string
+	err = pg.QueryRow(ctx, `SELECT client_ipv4, client_ipv6 FROM download_log WHERE download_id = $1`,
+		downloadID).Scan(&ipv4, &ipv6)
+	if err != nil {
+		return "", addressFamily{}, err
+	}
+	if ipv4 != nil {
+		return *ipv4, ipv4Family, nil
+	}
+	if ipv6 != nil {
+		return *ipv6, ipv6Family, nil
+	}
+	return "", addressFamily{}, fmt.Errorf("download ID '%d' has neither an IPv4 nor IPv6 address stored", downloadID)
 }